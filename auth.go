@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ----------------------
+// Auth and Access Tiers
+// ----------------------
+//
+// /api/action will happily run arbitrary shell and Python, so every
+// request is classified into one of three tiers before dispatch:
+//
+//   - Public:     no credential required.
+//   - Identified: a recognized bearer token or client cert.
+//   - Trusted:    a bearer token or client cert explicitly granted the
+//     trusted tier — required for anything that calls "sh" or "py"
+//     unless an action's actions.json entry says otherwise.
+
+// AccessTier ranks how much a caller needs to prove about itself before
+// an action will run.
+type AccessTier int
+
+const (
+	TierPublic AccessTier = iota
+	TierIdentified
+	TierTrusted
+)
+
+// parseAccessTier reads the "access" field from an actions.json entry.
+// An empty or unrecognized value means TierPublic, preserving the
+// pre-auth behavior for actions that don't opt in.
+func parseAccessTier(s string) AccessTier {
+	switch s {
+	case "trusted":
+		return TierTrusted
+	case "identified":
+		return TierIdentified
+	default:
+		return TierPublic
+	}
+}
+
+// Identity is who Hartley believes is making a request, and the tier
+// that identity has been granted.
+type Identity struct {
+	Subject string // bearer token label or cert fingerprint; empty means anonymous
+	Tier    AccessTier
+}
+
+// AuthConfig holds the credentials recognized by identifyRequest.
+type AuthConfig struct {
+	// BearerTokens maps a static token to the tier it grants.
+	BearerTokens map[string]string `json:"bearer_tokens"`
+	// MTLSWhitelists maps a tier ("identified"/"trusted") to a file of
+	// one hex-encoded SHA-256 client-cert fingerprint per line.
+	MTLSWhitelists map[string]string `json:"mtls_whitelists"`
+}
+
+// mtlsWhitelist holds the fingerprints loaded from config.Auth.MTLSWhitelists,
+// keyed by the tier they grant.
+var mtlsWhitelist = map[AccessTier]map[string]bool{}
+
+// loadMTLSWhitelists reads every whitelist file named in cfg so
+// identifyRequest doesn't hit disk per request.
+func loadMTLSWhitelists(cfg AuthConfig) error {
+	mtlsWhitelist = map[AccessTier]map[string]bool{}
+	for tierName, path := range cfg.MTLSWhitelists {
+		tier := parseAccessTier(tierName)
+		fingerprints, err := readFingerprintFile(path)
+		if err != nil {
+			return fmt.Errorf("reading mTLS whitelist %q: %w", path, err)
+		}
+		mtlsWhitelist[tier] = fingerprints
+	}
+	return nil
+}
+
+func readFingerprintFile(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result[strings.ToLower(line)] = true
+	}
+	return result, scanner.Err()
+}
+
+// identifyRequest derives the caller's Identity from either a client
+// certificate (preferred, when mutual TLS is in use) or an
+// "Authorization: Bearer ..." header.
+func identifyRequest(r *http.Request) Identity {
+	if r.TLS != nil {
+		for _, cert := range r.TLS.PeerCertificates {
+			fingerprint := certFingerprint(cert.Raw)
+			if mtlsWhitelist[TierTrusted][fingerprint] {
+				return Identity{Subject: "cert:" + fingerprint, Tier: TierTrusted}
+			}
+			if mtlsWhitelist[TierIdentified][fingerprint] {
+				return Identity{Subject: "cert:" + fingerprint, Tier: TierIdentified}
+			}
+		}
+	}
+
+	if token := bearerToken(r); token != "" {
+		if tierName, ok := config.Auth.BearerTokens[token]; ok {
+			return Identity{Subject: "token:" + tokenLabel(token), Tier: parseAccessTier(tierName)}
+		}
+	}
+
+	return Identity{Tier: TierPublic}
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer ..." header.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, prefix))
+}
+
+// tokenLabel returns a short, log-safe form of a bearer token so the
+// logs table never holds the credential itself.
+func tokenLabel(token string) string {
+	if len(token) <= 8 {
+		return "***"
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
+
+// certFingerprint hex-encodes the SHA-256 digest of a raw client certificate.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// requiredTier returns the access tier an action needs before it runs.
+// "py" and "sh" default to TierTrusted since they execute arbitrary
+// code; any action can override its tier via actions.json's "access"
+// field, including lowering py/sh's if an operator defines an explicit
+// "py" or "sh" entry.
+func requiredTier(actionName, prefix string) AccessTier {
+	lookupName := actionName
+	if prefix != "" {
+		lookupName = prefix
+	}
+	if act, ok := findAction(lookupName); ok {
+		return parseAccessTier(act.Access)
+	}
+	if prefix == "py" || prefix == "sh" {
+		return TierTrusted
+	}
+	return TierPublic
+}
+
+// migrateLogsTableIdentity adds the "identity" column logToDB writes the
+// caller's identity into, for databases created before auth existed.
+// SQLite has no "ADD COLUMN IF NOT EXISTS", so we check pragma table_info
+// first to keep this idempotent across restarts.
+func migrateLogsTableIdentity(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(logs)`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, colType string
+		var notNull, pk int
+		var dflt interface{}
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == "identity" {
+			return nil
+		}
+	}
+
+	_, err = db.Exec(`ALTER TABLE logs ADD COLUMN identity TEXT`)
+	return err
+}
+
+// accessTierName is the inverse of parseAccessTier, used when an Action's
+// Access field must be derived from a computed AccessTier (e.g. when
+// clamping a gallery manifest's requested access) rather than read
+// directly from actions.json.
+func accessTierName(tier AccessTier) string {
+	switch tier {
+	case TierTrusted:
+		return "trusted"
+	case TierIdentified:
+		return "identified"
+	default:
+		return "public"
+	}
+}
+
+// requiredTierForModel maps an OpenAI-surface "model" value onto the
+// same tiers requiredTier enforces for /api/action, since
+// hartley-py/hartley-sh route to the same code-executing handlers.
+func requiredTierForModel(model string) AccessTier {
+	switch model {
+	case "hartley-py":
+		return requiredTier("", "py")
+	case "hartley-sh":
+		return requiredTier("", "sh")
+	default:
+		return requiredTier(model, "")
+	}
+}
+
+// authorize reports whether identity meets the tier an action requires,
+// and the HTTP status to use when it doesn't: 401 when no recognized
+// credential was presented (none at all, or an unknown token or cert),
+// 403 when a recognized one was presented but isn't sufficient.
+func authorize(identity Identity, required AccessTier) (ok bool, status int) {
+	if identity.Tier >= required {
+		return true, http.StatusOK
+	}
+	if identity.Subject == "" {
+		return false, http.StatusUnauthorized
+	}
+	return false, http.StatusForbidden
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ----------------------
+// Action Gallery
+// ----------------------
+//
+// Extends the static actions/actions.json model with installable action
+// bundles: a gallery URL points at a YAML manifest describing a script,
+// its Python requirements, and checksums for everything it downloads.
+// Installing a bundle hot-registers it into the in-memory actions slice
+// so actionHandler can dispatch to it without a restart.
+//
+// When config.Galleries.TrustedSigningKeys is non-empty, a manifest is
+// only trusted if a detached ed25519 signature over its raw bytes,
+// fetched from "<manifest_url>.sig", verifies against one of those keys;
+// see verifyManifestSignature.
+
+// GalleryConfig configures where bundles come from by default.
+type GalleryConfig struct {
+	DefaultIndex string `json:"default_index"`
+	// TrustedSigningKeys lists hex-encoded ed25519 public keys allowed to
+	// sign a manifest. Empty means manifests aren't required to be
+	// signed, matching Hartley's other auth knobs (no token/whitelist
+	// configured means the check is a no-op).
+	TrustedSigningKeys []string `json:"trusted_signing_keys"`
+}
+
+// BundleManifest is the YAML document a gallery URL points to.
+type BundleManifest struct {
+	Name         string       `yaml:"name"`
+	Description  string       `yaml:"description"`
+	Requirements []string     `yaml:"requirements"`
+	Files        []BundleFile `yaml:"files"`
+	Script       string       `yaml:"script"`   // path, relative to the bundle dir, registered as the Action's Script
+	Function     string       `yaml:"function"` // function registered as the Action's Function
+	Access       string       `yaml:"access"`   // access tier required to invoke the installed action; defaults to "trusted"
+}
+
+// BundleFile is one file a manifest wants fetched and checksummed.
+type BundleFile struct {
+	Path   string `yaml:"path"` // destination, relative to the bundle dir
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+// actionsMu guards the package-level `actions` slice now that it can be
+// mutated at runtime by gallery installs/removals, not just at startup.
+var actionsMu sync.Mutex
+
+// galleryBundles tracks which actions came from the gallery so
+// galleryListHandler/galleryRemoveHandler don't have to rescan the
+// actions/ directory.
+var galleryBundles = map[string]bool{}
+
+// GalleryInstallRequest is the POST /api/gallery/install payload.
+type GalleryInstallRequest struct {
+	ManifestURL string `json:"manifest_url"`
+}
+
+// galleryInstallHandler implements POST /api/gallery/install.
+func galleryInstallHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	identity := identifyRequest(r)
+	if ok, status := authorize(identity, TierTrusted); !ok {
+		w.WriteHeader(status)
+		jsonResponse(w, map[string]string{"error": "installing a gallery bundle requires the trusted tier"})
+		return
+	}
+
+	var req GalleryInstallRequest
+	if err := jsonDecode(r, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	manifestURL := req.ManifestURL
+	if manifestURL == "" {
+		manifestURL = config.Galleries.DefaultIndex
+	}
+	if manifestURL == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": "manifest_url is required when no default gallery index is configured"})
+		return
+	}
+
+	act, err := installBundle(r.Context(), manifestURL, identity.Tier)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": err.Error()})
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{"installed": act.Name})
+}
+
+// installBundle downloads the manifest at manifestURL, verifies every
+// file's checksum, installs its Python requirements, and registers the
+// resulting action. installerTier is the access tier of the identity that
+// requested the install; the installed action's Access is never allowed
+// to grant a looser tier than that, so a manifest can't use "access:
+// public" to hand out unauthenticated code execution through a bundle
+// that only a trusted caller was able to install.
+func installBundle(ctx context.Context, manifestURL string, installerTier AccessTier) (Action, error) {
+	manifestBody, err := fetchURL(ctx, manifestURL)
+	if err != nil {
+		return Action{}, fmt.Errorf("fetching manifest: %w", err)
+	}
+	if err := verifyManifestSignature(ctx, manifestURL, manifestBody); err != nil {
+		return Action{}, fmt.Errorf("verifying manifest signature: %w", err)
+	}
+
+	var manifest BundleManifest
+	if err := yaml.Unmarshal(manifestBody, &manifest); err != nil {
+		return Action{}, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if manifest.Name == "" {
+		return Action{}, fmt.Errorf("manifest is missing a name")
+	}
+
+	bundleDir, err := safeJoin("actions", manifest.Name)
+	if err != nil {
+		return Action{}, fmt.Errorf("manifest name %q: %w", manifest.Name, err)
+	}
+	scriptPath, err := safeJoin(bundleDir, manifest.Script)
+	if err != nil {
+		return Action{}, fmt.Errorf("manifest script %q: %w", manifest.Script, err)
+	}
+	if strings.Contains(manifest.Function, "..") || strings.ContainsAny(manifest.Function, `/\`) {
+		return Action{}, fmt.Errorf("manifest function %q is not a valid identifier", manifest.Function)
+	}
+	if err := os.MkdirAll(bundleDir, 0o755); err != nil {
+		return Action{}, fmt.Errorf("creating bundle dir: %w", err)
+	}
+
+	for _, file := range manifest.Files {
+		if err := fetchAndVerify(ctx, file, bundleDir); err != nil {
+			os.RemoveAll(bundleDir)
+			return Action{}, fmt.Errorf("file %q: %w", file.Path, err)
+		}
+	}
+
+	if len(manifest.Requirements) > 0 {
+		if err := pipInstallTarget(bundleDir, manifest.Requirements); err != nil {
+			os.RemoveAll(bundleDir)
+			return Action{}, fmt.Errorf("installing requirements: %w", err)
+		}
+	}
+
+	requestedTier := TierTrusted
+	if manifest.Access != "" {
+		requestedTier = parseAccessTier(manifest.Access)
+	}
+	tier := requestedTier
+	if installerTier > tier {
+		tier = installerTier
+	}
+	act := Action{
+		Name:        manifest.Name,
+		Description: manifest.Description,
+		Script:      scriptPath,
+		Function:    manifest.Function,
+		Access:      accessTierName(tier),
+	}
+
+	actionsMu.Lock()
+	actions = append(actions, act)
+	galleryBundles[act.Name] = true
+	actionsMu.Unlock()
+
+	log.Printf("Installed gallery bundle %q from %s", act.Name, manifestURL)
+	return act, nil
+}
+
+// verifyManifestSignature checks manifestBody against a detached
+// signature fetched from "<manifestURL>.sig", a base64-encoded ed25519
+// signature over the raw manifest bytes. A manifest can't carry its own
+// signing key -- trusting a key the manifest itself supplies verifies
+// nothing -- so the signer's public key must already be in
+// config.Galleries.TrustedSigningKeys. If no trusted keys are
+// configured, signing isn't enforced.
+func verifyManifestSignature(ctx context.Context, manifestURL string, manifestBody []byte) error {
+	if len(config.Galleries.TrustedSigningKeys) == 0 {
+		return nil
+	}
+
+	sigBody, err := fetchURL(ctx, manifestURL+".sig")
+	if err != nil {
+		return fmt.Errorf("fetching signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigBody)))
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+
+	for _, keyHex := range config.Galleries.TrustedSigningKeys {
+		pubKey, err := hex.DecodeString(strings.TrimSpace(keyHex))
+		if err != nil || len(pubKey) != ed25519.PublicKeySize {
+			continue
+		}
+		if ed25519.Verify(pubKey, manifestBody, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature does not match any trusted signing key")
+}
+
+// fetchAndVerify downloads file.URL into bundleDir/file.Path and checks
+// its SHA-256 digest against file.SHA256.
+func fetchAndVerify(ctx context.Context, file BundleFile, bundleDir string) error {
+	body, err := fetchURL(ctx, file.URL)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, file.SHA256) {
+		return fmt.Errorf("checksum mismatch: got %s, want %s", got, file.SHA256)
+	}
+
+	dest, err := safeJoin(bundleDir, file.Path)
+	if err != nil {
+		return fmt.Errorf("file path %q: %w", file.Path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, body, 0o644)
+}
+
+// safeJoin joins base and untrusted into a path, rejecting untrusted if
+// it's absolute or if the joined result would escape base -- both
+// manifest.Name and file.Path come straight from an attacker-controlled
+// YAML manifest, so neither can be trusted to stay inside bundleDir/
+// actions/ on its own.
+func safeJoin(base, untrusted string) (string, error) {
+	if untrusted == "" || filepath.IsAbs(untrusted) || strings.Contains(untrusted, "..") {
+		return "", fmt.Errorf("invalid path %q", untrusted)
+	}
+	joined := filepath.Join(base, untrusted)
+	cleanBase := filepath.Clean(base)
+	if joined != cleanBase && !strings.HasPrefix(joined, cleanBase+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q", untrusted)
+	}
+	return joined, nil
+}
+
+// pipInstallTarget installs requirements into bundleDir/vendor via `pip
+// install --target` rather than a full venv per action. runPython does not
+// add bundleDir/vendor to the interpreter's import path; the bundle's
+// script has to put it on sys.path itself.
+func pipInstallTarget(bundleDir string, requirements []string) error {
+	vendorDir := filepath.Join(bundleDir, "vendor")
+	if err := os.MkdirAll(vendorDir, 0o755); err != nil {
+		return err
+	}
+	args := append([]string{"install", "--target", vendorDir}, requirements...)
+	cmd := exec.Command("pip", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, string(out))
+	}
+	return nil
+}
+
+// fetchURL does a plain GET and returns the body, bounded by ctx.
+func fetchURL(ctx context.Context, url string) ([]byte, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// galleryListHandler implements GET /api/gallery/list.
+func galleryListHandler(w http.ResponseWriter, r *http.Request) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+
+	names := make([]string, 0, len(galleryBundles))
+	for name := range galleryBundles {
+		names = append(names, name)
+	}
+	jsonResponse(w, map[string]interface{}{"installed": names})
+}
+
+// galleryRemoveHandler implements POST /api/gallery/remove/{name}.
+func galleryRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identifyRequest(r)
+	if ok, status := authorize(identity, TierTrusted); !ok {
+		w.WriteHeader(status)
+		jsonResponse(w, map[string]string{"error": "removing a gallery bundle requires the trusted tier"})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/gallery/remove/")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": "missing bundle name"})
+		return
+	}
+
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+
+	if !galleryBundles[name] {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, map[string]string{"error": fmt.Sprintf("no installed bundle named %q", name)})
+		return
+	}
+
+	kept := actions[:0]
+	for _, act := range actions {
+		if act.Name != name {
+			kept = append(kept, act)
+		}
+	}
+	actions = kept
+	delete(galleryBundles, name)
+
+	if err := os.RemoveAll(filepath.Join("actions", name)); err != nil {
+		log.Printf("Error removing bundle dir for %q: %v", name, err)
+	}
+
+	jsonResponse(w, map[string]string{"removed": name})
+}
+
+// findAction looks up a registered action by name, guarded by
+// actionsMu since gallery installs/removals can mutate the slice at
+// runtime now.
+func findAction(name string) (Action, bool) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	for _, act := range actions {
+		if act.Name == name {
+			return act, true
+		}
+	}
+	return Action{}, false
+}
+
+// jsonDecode decodes r.Body into v; split out for readability at the
+// gallery handlers' call sites.
+func jsonDecode(r *http.Request, v interface{}) error {
+	return json.NewDecoder(r.Body).Decode(v)
+}
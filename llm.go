@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ----------------------
+// Backend Interface
+// ----------------------
+
+// GenOpts carries per-request generation parameters. A zero field means
+// "use the backend's default". Not every backend reads every field: the
+// OpenAI backend reads all three, falling back to its configured model
+// and temperature; the Anthropic backend reads Model and MaxTokens; the
+// Ollama backend reads only Model; the Gemini backend ignores GenOpts.
+type GenOpts struct {
+	Model       string
+	Temperature float64
+	// MaxTokens caps the length of the completion. Zero leaves the
+	// provider's own limit in place (1024 for the Anthropic backend).
+	MaxTokens int
+}
+
+// Backend is implemented by anything that can turn a prompt into text,
+// whether that's a hosted API like Gemini/OpenAI/Anthropic or a local
+// Ollama daemon. handlePythonCommand and handleConversational only ever
+// talk to a Backend, never to a specific provider's wire format.
+type Backend interface {
+	// Generate returns the full completion for prompt in one shot.
+	Generate(ctx context.Context, prompt string, opts GenOpts) (string, error)
+	// Name identifies the backend for logging and routing.
+	Name() string
+}
+
+// backends holds every configured Backend, keyed by the name it was
+// registered under in config.json's "backends" map.
+var backends map[string]Backend
+
+// loadBackends builds a Backend for every entry in config.Backends. If
+// no backends are configured, it falls back to a single "gemini" entry
+// built from the legacy GeminiAPIKey/GeminiEndpoint fields so existing
+// config.json files keep working unmodified.
+func loadBackends(cfg Config) (map[string]Backend, error) {
+	result := make(map[string]Backend)
+
+	if len(cfg.Backends) == 0 {
+		result["gemini"] = &geminiBackend{
+			name: "gemini",
+			cfg: BackendConfig{
+				Type:     "gemini",
+				Endpoint: cfg.GeminiEndpoint,
+				APIKey:   cfg.GeminiAPIKey,
+			},
+		}
+		return result, nil
+	}
+
+	for name, bcfg := range cfg.Backends {
+		backend, err := newBackend(name, bcfg)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = backend
+	}
+	return result, nil
+}
+
+// newBackend builds the concrete Backend implementation named by
+// cfg.Type.
+func newBackend(name string, cfg BackendConfig) (Backend, error) {
+	switch cfg.Type {
+	case "gemini", "":
+		return &geminiBackend{name: name, cfg: cfg}, nil
+	case "openai":
+		return &openAIBackend{name: name, cfg: cfg}, nil
+	case "anthropic":
+		return &anthropicBackend{name: name, cfg: cfg}, nil
+	case "ollama":
+		return &ollamaBackend{name: name, cfg: cfg}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend type %q for backend %q", cfg.Type, name)
+	}
+}
+
+// coderBackend returns the Backend that should handle "py"-prefixed
+// commands, falling back to the chat backend when none is configured.
+func coderBackend() (Backend, error) {
+	name := config.CoderBackend
+	if name == "" {
+		return chatBackend()
+	}
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("coder_backend %q is not a configured backend", name)
+	}
+	return b, nil
+}
+
+// generate calls backend.Generate and records hartley_llm_requests_total
+// / hartley_llm_latency_seconds around it. handlePythonCommand and
+// handleConversational call this instead of backend.Generate directly
+// so every provider gets the same instrumentation.
+func generate(ctx context.Context, backend Backend, prompt string, opts GenOpts) (string, error) {
+	start := time.Now()
+	text, err := backend.Generate(ctx, prompt, opts)
+	observeGenerate(backend.Name(), err, start)
+	return text, err
+}
+
+// chatBackend returns the Backend that should handle conversational
+// requests, falling back to "gemini" for existing config.json files.
+func chatBackend() (Backend, error) {
+	name := config.ChatBackend
+	if name == "" {
+		name = "gemini"
+	}
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("chat_backend %q is not a configured backend", name)
+	}
+	return b, nil
+}
+
+// ----------------------
+// Gemini Backend
+// ----------------------
+
+type GeminiPart struct {
+	Text string `json:"text"`
+}
+
+type GeminiContent struct {
+	Parts []GeminiPart `json:"parts"`
+	Role  string       `json:"role"`
+}
+
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason"`
+}
+
+type GeminiResponse struct {
+	Candidates []GeminiCandidate `json:"candidates"`
+	// Other fields are omitted for brevity.
+}
+
+type geminiBackend struct {
+	name string
+	cfg  BackendConfig
+}
+
+func (g *geminiBackend) Name() string { return g.name }
+
+func (g *geminiBackend) Generate(ctx context.Context, prompt string, opts GenOpts) (string, error) {
+	geminiReq := map[string]interface{}{
+		"contents": []map[string]interface{}{
+			{
+				"parts": []map[string]string{
+					{"text": prompt},
+				},
+			},
+		},
+	}
+	reqBody, err := json.Marshal(geminiReq)
+	if err != nil {
+		return "", fmt.Errorf("marshalling Gemini request: %w", err)
+	}
+
+	url := fmt.Sprintf("%s?key=%s", g.cfg.Endpoint, g.cfg.APIKey)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("building Gemini request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("calling Gemini API: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading Gemini response: %w", err)
+	}
+
+	var geminiResp GeminiResponse
+	if err = json.Unmarshal(body, &geminiResp); err != nil {
+		return "", fmt.Errorf("parsing Gemini response: %w", err)
+	}
+	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
+		return "", fmt.Errorf("no content generated by Gemini")
+	}
+	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
+}
+
+// ----------------------
+// OpenAI Backend
+// ----------------------
+
+type openAIBackend struct {
+	name string
+	cfg  BackendConfig
+}
+
+func (o *openAIBackend) Name() string { return o.name }
+
+func (o *openAIBackend) Generate(ctx context.Context, prompt string, opts GenOpts) (string, error) {
+	model := opts.Model
+	if model == "" {
+		model = o.cfg.Model
+	}
+	temperature := opts.Temperature
+	if temperature == 0 {
+		temperature = o.cfg.Temperature
+	}
+
+	payload := map[string]interface{}{
+		"model": model,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+		"temperature": temperature,
+	}
+	if opts.MaxTokens > 0 {
+		payload["max_tokens"] = opts.MaxTokens
+	}
+
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshalling OpenAI request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.Endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("building OpenAI request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+o.cfg.APIKey)
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("calling OpenAI API: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading OpenAI response: %w", err)
+	}
+
+	var parsed struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("parsing OpenAI response: %w", err)
+	}
+	if len(parsed.Choices) == 0 {
+		return "", fmt.Errorf("no content generated by OpenAI")
+	}
+	return parsed.Choices[0].Message.Content, nil
+}
+
+// ----------------------
+// Anthropic Backend
+// ----------------------
+
+type anthropicBackend struct {
+	name string
+	cfg  BackendConfig
+}
+
+func (a *anthropicBackend) Name() string { return a.name }
+
+func (a *anthropicBackend) Generate(ctx context.Context, prompt string, opts GenOpts) (string, error) {
+	model := opts.Model
+	if model == "" {
+		model = a.cfg.Model
+	}
+	maxTokens := opts.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = 1024
+	}
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model":      model,
+		"max_tokens": maxTokens,
+		"messages": []map[string]string{
+			{"role": "user", "content": prompt},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshalling Anthropic request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.Endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("building Anthropic request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", a.cfg.APIKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("calling Anthropic API: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading Anthropic response: %w", err)
+	}
+
+	var parsed struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("parsing Anthropic response: %w", err)
+	}
+	if len(parsed.Content) == 0 {
+		return "", fmt.Errorf("no content generated by Anthropic")
+	}
+	return parsed.Content[0].Text, nil
+}
+
+// ----------------------
+// Ollama Backend
+// ----------------------
+
+// ollamaBackend talks to a local Ollama daemon, letting Hartley run
+// fully offline with no hosted API key at all.
+type ollamaBackend struct {
+	name string
+	cfg  BackendConfig
+}
+
+func (o *ollamaBackend) Name() string { return o.name }
+
+func (o *ollamaBackend) Generate(ctx context.Context, prompt string, opts GenOpts) (string, error) {
+	model := opts.Model
+	if model == "" {
+		model = o.cfg.Model
+	}
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+		"stream": false,
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshalling Ollama request: %w", err)
+	}
+
+	endpoint := o.cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "http://localhost:11434/api/generate"
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("building Ollama request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("calling Ollama API: %w", err)
+	}
+	defer httpResp.Body.Close()
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading Ollama response: %w", err)
+	}
+
+	var parsed struct {
+		Response string `json:"response"`
+	}
+	if err = json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("parsing Ollama response: %w", err)
+	}
+	return parsed.Response, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ----------------------
+// Metrics
+// ----------------------
+//
+// Everything here is wired into actionHandler, runPython, and the
+// backend Generate calls so operators can see request volume, latency,
+// and failure rates without grepping logs.
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	inFlightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hartley_inflight_requests",
+		Help: "Number of /api/action requests currently being handled.",
+	})
+
+	actionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hartley_action_requests_total",
+		Help: "Total /api/action requests, labeled by action, prefix, and outcome.",
+	}, []string{"action", "prefix", "outcome"})
+
+	actionDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "hartley_action_duration_seconds",
+		Help: "Time to fully handle an /api/action request, labeled by action.",
+	}, []string{"action"})
+
+	llmRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hartley_llm_requests_total",
+		Help: "Total backend.Generate calls, labeled by backend and outcome.",
+	}, []string{"backend", "outcome"})
+
+	llmLatencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "hartley_llm_latency_seconds",
+		Help: "Latency of backend.Generate calls, labeled by backend.",
+	}, []string{"backend"})
+
+	pythonExecDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "hartley_python_exec_duration_seconds",
+		Help: "Wall-clock time spent running a sandboxed Python script.",
+	})
+
+	pythonExecFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hartley_python_exec_failures_total",
+		Help: "Sandboxed Python executions that failed, labeled by reason.",
+	}, []string{"reason"})
+
+	sqliteLogFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hartley_sqlite_log_failures_total",
+		Help: "Failures inserting a request/response pair into the logs table.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		inFlightRequests,
+		actionRequestsTotal,
+		actionDurationSeconds,
+		llmRequestsTotal,
+		llmLatencySeconds,
+		pythonExecDurationSeconds,
+		pythonExecFailuresTotal,
+		sqliteLogFailuresTotal,
+	)
+}
+
+// metricsHandler serves /metrics in the Prometheus text format, gated by
+// the same tiered identity/authorize() middleware that every other
+// operator-facing endpoint uses, rather than a bespoke static token.
+func metricsHandler() http.Handler {
+	inner := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identifyRequest(r)
+		if ok, status := authorize(identity, TierTrusted); !ok {
+			w.WriteHeader(status)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// metricsPath resolves the path /metrics is served on, defaulting to "/metrics".
+func metricsPath() string {
+	if config.MetricsPath != "" {
+		return config.MetricsPath
+	}
+	return "/metrics"
+}
+
+// actionOutcome derives the "outcome" label from a handler's response:
+// any response carrying an "error" key counts as a failure.
+func actionOutcome(resp map[string]interface{}) string {
+	if _, ok := resp["error"]; ok {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeAction records actionRequestsTotal/actionDurationSeconds for one
+// /api/action request. Call it once near the top of actionHandler and
+// defer the returned func, passing the outcome once resp is known. label
+// should come from metricsActionLabel, not the raw request action, so
+// the registry's cardinality stays bounded.
+func observeAction(label, prefix string) func(outcome string) {
+	inFlightRequests.Inc()
+	start := time.Now()
+	return func(outcome string) {
+		inFlightRequests.Dec()
+		actionDurationSeconds.WithLabelValues(label).Observe(time.Since(start).Seconds())
+		actionRequestsTotal.WithLabelValues(label, prefix, outcome).Inc()
+	}
+}
+
+// metricsActionLabel derives a bounded metrics label for an /api/action
+// request: "py"/"sh" for prefixed commands, the matched action name for
+// a locally-registered or gallery-installed action, and a fixed
+// "conversational" bucket for the free-text fallback. It deliberately
+// never returns the raw, user-controlled action string -- every unique
+// value passed to a Prometheus label permanently allocates a new time
+// series, and actionName is either the user's whole command or their
+// whole conversational query.
+func metricsActionLabel(actionName, prefix string) string {
+	if prefix == "py" || prefix == "sh" {
+		return prefix
+	}
+	if _, ok := findAction(actionName); ok {
+		return actionName
+	}
+	return "conversational"
+}
+
+// observeGenerate records llmRequestsTotal/llmLatencySeconds around a
+// single backend.Generate call.
+func observeGenerate(backendName string, err error, start time.Time) {
+	llmLatencySeconds.WithLabelValues(backendName).Observe(time.Since(start).Seconds())
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	llmRequestsTotal.WithLabelValues(backendName, outcome).Inc()
+}
+
+// observePythonExec records pythonExecDurationSeconds/pythonExecFailuresTotal
+// around a single runPython call.
+func observePythonExec(err error, start time.Time) {
+	pythonExecDurationSeconds.Observe(time.Since(start).Seconds())
+	if err == nil {
+		return
+	}
+	reason := "error"
+	var sandboxErr *SandboxError
+	if errors.As(err, &sandboxErr) {
+		reason = sandboxErr.Reason
+	}
+	pythonExecFailuresTotal.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ----------------------
+// OpenAI-compatible HTTP surface
+// ----------------------
+//
+// These handlers let any OpenAI SDK, LangChain, or off-the-shelf chat UI
+// talk to Hartley without knowing about the bespoke {"action": ...,
+// "params": ...} format: a "model" of "hartley-py" routes through
+// handlePythonCommand, "hartley-sh" through handleShellCommand, and
+// "hartley-chat" (or anything else) through handleConversational.
+
+// ChatMessage is one entry in an OpenAI chat completion's messages array.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatCompletionRequest mirrors the OpenAI /v1/chat/completions request body.
+type ChatCompletionRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Stream      bool          `json:"stream"`
+	Temperature float64       `json:"temperature"`
+	MaxTokens   int           `json:"max_tokens"`
+}
+
+// CompletionRequest mirrors the OpenAI /v1/completions request body.
+type CompletionRequest struct {
+	Model       string  `json:"model"`
+	Prompt      string  `json:"prompt"`
+	Stream      bool    `json:"stream"`
+	Temperature float64 `json:"temperature"`
+	MaxTokens   int     `json:"max_tokens"`
+}
+
+// hartleyModels lists the models Hartley advertises via /v1/models, each
+// mapped to one of the existing action-pipeline entry points.
+var hartleyModels = []string{"hartley-py", "hartley-sh", "hartley-chat"}
+
+// dispatchModel runs payload through the action-pipeline handler that the
+// given model name maps to, passing opts through to whichever handler
+// calls an LLM backend.
+func dispatchModel(ctx context.Context, model, payload string, opts GenOpts) map[string]interface{} {
+	switch model {
+	case "hartley-py":
+		return handlePythonCommand(ctx, payload, opts)
+	case "hartley-sh":
+		return handleShellCommand(ctx, payload)
+	default:
+		return handleConversational(ctx, payload, opts)
+	}
+}
+
+// resultToContent flattens a Hartley action response down to the string
+// an OpenAI-style client expects as message/completion content: the
+// "result" field when present, otherwise the whole response as JSON.
+func resultToContent(resp map[string]interface{}) string {
+	if result, ok := resp["result"]; ok {
+		if s, ok := result.(string); ok {
+			return s
+		}
+		if b, err := json.Marshal(result); err == nil {
+			return string(b)
+		}
+	}
+	if b, err := json.Marshal(resp); err == nil {
+		return string(b)
+	}
+	return fmt.Sprintf("%v", resp)
+}
+
+// lastUserMessage returns the content of the last "user" message in the
+// request, which is what we forward to the action pipeline; earlier
+// turns aren't modeled by the current handlers.
+func lastUserMessage(messages []ChatMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// chatCompletionsHandler implements POST /v1/chat/completions.
+func chatCompletionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	identity := identifyRequest(r)
+	if ok, status := authorize(identity, requiredTierForModel(req.Model)); !ok {
+		w.WriteHeader(status)
+		jsonResponse(w, map[string]string{"error": "insufficient access tier for this model"})
+		return
+	}
+
+	payload := lastUserMessage(req.Messages)
+	opts := GenOpts{Temperature: req.Temperature, MaxTokens: req.MaxTokens}
+	resp := dispatchModel(r.Context(), req.Model, payload, opts)
+	content := resultToContent(resp)
+	logToDB(req.Model, req, resp, identity)
+
+	id := fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	if req.Stream {
+		streamSSE(w, id, created, req.Model, content)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": created,
+		"model":   req.Model,
+		"choices": []map[string]interface{}{
+			{
+				"index": 0,
+				"message": ChatMessage{
+					Role:    "assistant",
+					Content: content,
+				},
+				"finish_reason": "stop",
+			},
+		},
+	})
+}
+
+// completionsHandler implements POST /v1/completions.
+func completionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	var req CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, map[string]string{"error": "Invalid JSON"})
+		return
+	}
+
+	identity := identifyRequest(r)
+	if ok, status := authorize(identity, requiredTierForModel(req.Model)); !ok {
+		w.WriteHeader(status)
+		jsonResponse(w, map[string]string{"error": "insufficient access tier for this model"})
+		return
+	}
+
+	opts := GenOpts{Temperature: req.Temperature, MaxTokens: req.MaxTokens}
+	resp := dispatchModel(r.Context(), req.Model, req.Prompt, opts)
+	content := resultToContent(resp)
+	logToDB(req.Model, req, resp, identity)
+
+	id := fmt.Sprintf("cmpl-%d", time.Now().UnixNano())
+	created := time.Now().Unix()
+
+	if req.Stream {
+		streamSSE(w, id, created, req.Model, content)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"id":      id,
+		"object":  "text_completion",
+		"created": created,
+		"model":   req.Model,
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"text":          content,
+				"finish_reason": "stop",
+			},
+		},
+	})
+}
+
+// modelsHandler implements GET /v1/models.
+func modelsHandler(w http.ResponseWriter, r *http.Request) {
+	data := make([]map[string]interface{}, 0, len(hartleyModels))
+	for _, name := range hartleyModels {
+		data = append(data, map[string]interface{}{
+			"id":       name,
+			"object":   "model",
+			"owned_by": "hartley",
+		})
+	}
+	jsonResponse(w, map[string]interface{}{
+		"object": "list",
+		"data":   data,
+	})
+}
+
+// streamSSE writes a single completion as OpenAI-style SSE chunks
+// followed by a terminating "[DONE]" frame. Hartley's current backends
+// don't stream token-by-token, so the whole content is sent as one
+// delta; this still satisfies clients that only know how to consume SSE.
+func streamSSE(w http.ResponseWriter, id string, created int64, model, content string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonResponse(w, map[string]string{"error": "Streaming not supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	chunk := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{
+				"index": 0,
+				"delta": map[string]string{
+					"content": content,
+				},
+				"finish_reason": nil,
+			},
+		},
+	}
+	writeSSEFrame(w, chunk)
+	flusher.Flush()
+
+	final := map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": created,
+		"model":   model,
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"delta":         map[string]string{},
+				"finish_reason": "stop",
+			},
+		},
+	}
+	writeSSEFrame(w, final)
+	flusher.Flush()
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// writeSSEFrame marshals data and writes it as a single "data: ...\n\n" frame.
+func writeSSEFrame(w http.ResponseWriter, data interface{}) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", strings.TrimSpace(string(b)))
+}
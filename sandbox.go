@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ----------------------
+// Sandboxed Python Execution
+// ----------------------
+//
+// Gemini-generated (or any backend-generated) Python runs with no
+// supervision from the language model, so it gets the same treatment as
+// any other untrusted input: a deadline, a cap on how much output it may
+// produce, and a throwaway working directory.
+
+const (
+	// defaultActionDeadline bounds how long a single generated script may
+	// run before it's killed.
+	defaultActionDeadline = 15 * time.Second
+	// defaultOutputCap bounds how many bytes of combined stdout/stderr a
+	// script may produce before it's killed; this stops a `while True:
+	// print("x")` from exhausting memory.
+	defaultOutputCap = 1 << 20 // 1 MiB
+)
+
+// sandboxWrapper optionally wraps the interpreter invocation in a
+// container/jail command (e.g. "nsjail", "firejail"), configured via
+// config.json. Empty means run the interpreter directly.
+var sandboxWrapper string
+
+// SandboxError reports why a sandboxed run was killed, along with
+// whatever output the script had produced up to that point. Callers
+// that want the `{"error": "...", "partial_output": "..."}` contract
+// should check errors.As for this type.
+type SandboxError struct {
+	Reason  string // "timeout" or "output cap exceeded"
+	Partial []byte
+}
+
+func (e *SandboxError) Error() string {
+	return fmt.Sprintf("sandbox: %s", e.Reason)
+}
+
+// limitedWriter caps how many bytes it will buffer before reporting
+// errOutputCapExceeded, so a runaway child can't be read to exhaustion.
+// Write alone can't stop the child, though -- a child that ignores the
+// write error it gets once the pipe backs up just spins until something
+// else kills it -- so limitedWriter also closes tripped the first time
+// the cap is hit, letting a caller monitor it concurrently with Run and
+// kill the process group right away instead of waiting for it to return.
+type limitedWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	limit   int
+	tripped chan struct{}
+	once    sync.Once
+}
+
+func newLimitedWriter(limit int) *limitedWriter {
+	return &limitedWriter{limit: limit, tripped: make(chan struct{})}
+}
+
+var errOutputCapExceeded = errors.New("output cap exceeded")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() >= w.limit {
+		w.trip()
+		return len(p), errOutputCapExceeded
+	}
+	room := w.limit - w.buf.Len()
+	if room > len(p) {
+		room = len(p)
+	}
+	w.buf.Write(p[:room])
+	if room < len(p) {
+		w.trip()
+		return len(p), errOutputCapExceeded
+	}
+	return len(p), nil
+}
+
+// trip closes tripped the first time the cap is exceeded, waking up
+// whatever goroutine is watching for it.
+func (w *limitedWriter) trip() {
+	w.once.Do(func() { close(w.tripped) })
+}
+
+// Len reports how many bytes are buffered so far, synchronized against
+// concurrent Writes (Stdout and Stderr are both wired to the same
+// limitedWriter, so two copy goroutines can call Write at once).
+func (w *limitedWriter) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Len()
+}
+
+// Bytes returns a copy of what's been buffered so far.
+func (w *limitedWriter) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]byte(nil), w.buf.Bytes()...)
+}
+
+// runPython attempts to run the Python script using "python3" first,
+// falling back to "python" and then "py" (the Windows launcher). The run
+// is bounded by a deadline derived from ctx and by defaultOutputCap;
+// either limit being hit kills the whole process group and returns a
+// *SandboxError rather than leaving an orphaned interpreter behind.
+func runPython(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := runPythonWith(ctx, "python3", args)
+	if err != nil && (errors.Is(err, exec.ErrNotFound) || strings.Contains(string(out), "Python was not found")) {
+		log.Printf("python3 not found, falling back to python")
+		out, err = runPythonWith(ctx, "python", args)
+		if err != nil && (errors.Is(err, exec.ErrNotFound) || strings.Contains(string(out), "Python was not found")) {
+			log.Printf("python not found, falling back to py")
+			out, err = runPythonWith(ctx, "py", args)
+		}
+	}
+	return out, err
+}
+
+// runPythonWith runs a single interpreter candidate inside the sandbox:
+// a deadline, a dedicated workdir removed on return, and an output cap
+// enforced by killing the process group on overflow.
+func runPythonWith(ctx context.Context, interpreter string, args []string) (output []byte, err error) {
+	start := time.Now()
+	defer func() { observePythonExec(err, start) }()
+
+	deadlineCtx, cancel := context.WithTimeout(ctx, defaultActionDeadline)
+	defer cancel()
+
+	workdir, dirErr := ioutil.TempDir("", "hartley_sandbox_*")
+	if dirErr != nil {
+		err = fmt.Errorf("creating sandbox workdir: %w", dirErr)
+		return nil, err
+	}
+	defer os.RemoveAll(workdir)
+
+	// The child runs in workdir, so a script path relative to the server's
+	// working directory (e.g. "python/action_runner.py") is made absolute.
+	if len(args) > 0 && !filepath.IsAbs(args[0]) {
+		if abs, absErr := filepath.Abs(args[0]); absErr == nil {
+			args = append([]string{abs}, args[1:]...)
+		}
+	}
+
+	name, cmdArgs := interpreter, args
+	if sandboxWrapper != "" {
+		name, cmdArgs = sandboxWrapper, append([]string{interpreter}, args...)
+	}
+
+	cmd := exec.CommandContext(deadlineCtx, name, cmdArgs...)
+	cmd.Dir = workdir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	buf := newLimitedWriter(defaultOutputCap)
+	cmd.Stdout = buf
+	cmd.Stderr = buf
+
+	// Write() reports errOutputCapExceeded to whichever copy goroutine
+	// hit it, but a child that swallows that write error (e.g. catching
+	// BrokenPipeError) would otherwise keep running until the deadline.
+	// Watch buf.tripped and deadlineCtx concurrently with Wait so the cap
+	// is enforced on its own, and so a forked grandchild still holding
+	// stdout can't keep Wait blocked past the deadline.
+	runDone := make(chan struct{})
+	defer close(runDone)
+	cmdErr := cmd.Start()
+	if cmdErr == nil {
+		go func() {
+			select {
+			case <-buf.tripped:
+				killProcessGroup(cmd)
+			case <-deadlineCtx.Done():
+				killProcessGroup(cmd)
+			case <-runDone:
+			}
+		}()
+		cmdErr = cmd.Wait()
+	}
+
+	if buf.Len() >= defaultOutputCap {
+		killProcessGroup(cmd)
+		err = &SandboxError{Reason: "output cap exceeded", Partial: buf.Bytes()}
+		return buf.Bytes(), err
+	}
+	if deadlineCtx.Err() == context.DeadlineExceeded {
+		killProcessGroup(cmd)
+		err = &SandboxError{Reason: "timeout", Partial: buf.Bytes()}
+		return buf.Bytes(), err
+	}
+	err = cmdErr
+	return buf.Bytes(), err
+}
+
+// killProcessGroup kills the whole process group started for cmd so
+// that a child which has itself forked (or a wrapper like nsjail) can't
+// outlive the deadline or output cap that killed its parent.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		// Not a process group (or already dead); fall back to killing
+		// just the one process.
+		cmd.Process.Kill()
+	}
+}
+
+// sandboxErrorResponse turns a *SandboxError into the structured
+// {"error": ..., "partial_output": ...} shape clients should see on
+// timeout or output-cap overflow.
+func sandboxErrorResponse(err *SandboxError) map[string]interface{} {
+	return map[string]interface{}{
+		"error":          err.Reason,
+		"partial_output": string(err.Partial),
+	}
+}